@@ -10,100 +10,35 @@ but without using atomic package.
 
 - loopAtomic: increments shared pointer in the loop using atomic package.
 
-Variable 'routineCount' set the number of goroutines which run in parallel.
-Use 'GOMAXPROCS=N' env var to set the these when running the tests.
+Parallelism is driven by b.RunParallel and defaults to GOMAXPROCS; pass
+'-cpu=1,2,4,8,...' to go test to sweep it, or use the '*Slack' variants to
+see what happens when parallelism is pushed past GOMAXPROCS.
 
 It is expected that performance of functions accessing shared pointer will
 degrade with increased number of goroutines due to CPU cache contention and
 invalidation.
 
-Results on my local MBP:
-
-	Philips-MBP:go-bench philip$ GOMAXPROCS=1 go test -v -bench=. -benchtime 100x
-	2019/11/18 11:28:13 Number of goroutines: 1
-	goos: darwin
-	goarch: amd64
-	pkg: github.com/ppanyukov/go-bench
-	BenchmarkLoopNoPtr  	     100	   6799168 ns/op
-	BenchmarkLoop       	     100	   6689403 ns/op
-	BenchmarkLoopAtomic 	     100	  10230860 ns/op
-	PASS
-	ok  	github.com/ppanyukov/go-bench	2.407s
-
-	Philips-MBP:go-bench philip$ GOMAXPROCS=2 go test -v -bench=. -benchtime 100x
-	2019/11/18 11:28:19 Number of goroutines: 2
-	goos: darwin
-	goarch: amd64
-	pkg: github.com/ppanyukov/go-bench
-	BenchmarkLoopNoPtr-2    	     100	   7133741 ns/op
-	BenchmarkLoop-2         	     100	  25968322 ns/op
-	BenchmarkLoopAtomic-2   	     100	  34951884 ns/op
-	PASS
-	ok  	github.com/ppanyukov/go-bench	6.889s
-
-	Philips-MBP:go-bench philip$ GOMAXPROCS=4 go test -v -bench=. -benchtime 100x
-	2019/11/18 11:28:32 Number of goroutines: 4
-	goos: darwin
-	goarch: amd64
-	pkg: github.com/ppanyukov/go-bench
-	BenchmarkLoopNoPtr-4    	     100	   7275700 ns/op
-	BenchmarkLoop-4         	     100	  60480862 ns/op
-	BenchmarkLoopAtomic-4   	     100	  69067172 ns/op
-	PASS
-	ok  	github.com/ppanyukov/go-bench	13.853s
-
-	Philips-MBP:go-bench philip$ GOMAXPROCS=8 go test -v -bench=. -benchtime 100x
-	2019/11/18 11:28:57 Number of goroutines: 8
-	goos: darwin
-	goarch: amd64
-	pkg: github.com/ppanyukov/go-bench
-	BenchmarkLoopNoPtr-8    	     100	   8194569 ns/op
-	BenchmarkLoop-8         	     100	 112466232 ns/op
-	BenchmarkLoopAtomic-8   	     100	 123464570 ns/op
-	PASS
-	ok  	github.com/ppanyukov/go-bench	24.651s
-
-	Philips-MBP:go-bench philip$ GOMAXPROCS=16 go test -v -bench=. -benchtime 100x
-	2019/11/18 11:29:34 Number of goroutines: 16
-	goos: darwin
-	goarch: amd64
-	pkg: github.com/ppanyukov/go-bench
-	BenchmarkLoopNoPtr-16     	     100	  15091715 ns/op
-	BenchmarkLoop-16          	     100	 142919302 ns/op
-	BenchmarkLoopAtomic-16    	     100	 184546588 ns/op
-	PASS
-	ok  	github.com/ppanyukov/go-bench	34.631s
-
-	Philips-MBP:go-bench philip$ GOMAXPROCS=24 go test -v -bench=. -benchtime 100x
-	2019/11/18 11:30:17 Number of goroutines: 24
-	goos: darwin
-	goarch: amd64
-	pkg: github.com/ppanyukov/go-bench
-	BenchmarkLoopNoPtr-24     	     100	  24720759 ns/op
-	BenchmarkLoop-24          	     100	 176428833 ns/op
-	BenchmarkLoopAtomic-24    	     100	 236355064 ns/op
-	PASS
-	ok  	github.com/ppanyukov/go-bench	44.192s
-
+The sample results that used to live in this comment were measured against
+the old sync.WaitGroup-based implementation, where each "op" was an entire
+batch of routineCount goroutines, each running its full loopCount
+iterations. Now that these benchmarks run under
+b.RunParallel, an "op" is one such loop run by one of b's parallel workers,
+so the old ns/op numbers are not comparable to what's reported today. Run
+`go test -cpu=1,2,4,8,16,24 -bench=. .` to get current numbers for your
+machine.
 */
 package go_bench
 
 import (
-	"log"
 	"math"
 	"math/rand"
 	"runtime"
-	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
-)
 
-var routineCount = func() int {
-	res := runtime.GOMAXPROCS(-1)
-	log.Printf("Number of goroutines: %d\n", res)
-	return res
-}()
+	"github.com/ppanyukov/go-bench/padded"
+)
 
 var loopCount = 1000000
 
@@ -153,46 +88,70 @@ func loopAtomic(loopCount int, totalCounter *int64) {
 }
 
 func BenchmarkLoopNoPtr(b *testing.B) {
-	for i := 0; i < b.N; i++ {
-		wg := sync.WaitGroup{}
-		for r := 0; r < routineCount; r++ {
-			wg.Add(1)
-			totalCounter := int64(0)
-			go func() {
-				defer wg.Done()
-				loopLocalNoPtr(loopCount, &totalCounter)
-			}()
+	b.SetParallelism(runtime.GOMAXPROCS(-1))
+	b.RunParallel(func(pb *testing.PB) {
+		totalCounter := padded.PaddedInt64{}
+		for pb.Next() {
+			loopLocalNoPtr(loopCount, &totalCounter.V)
 		}
-		wg.Wait()
-	}
+	})
+}
+
+// BenchmarkLoopNoPtrSlack runs with 10x the parallelism of GOMAXPROCS, to
+// model an overcommitted scheduler where more goroutines are runnable than
+// there are Ps to run them.
+func BenchmarkLoopNoPtrSlack(b *testing.B) {
+	b.SetParallelism(runtime.GOMAXPROCS(-1) * 10)
+	b.RunParallel(func(pb *testing.PB) {
+		totalCounter := padded.PaddedInt64{}
+		for pb.Next() {
+			loopLocalNoPtr(loopCount, &totalCounter.V)
+		}
+	})
 }
 
 func BenchmarkLoop(b *testing.B) {
-	for i := 0; i < b.N; i++ {
-		wg := sync.WaitGroup{}
-		for r := 0; r < routineCount; r++ {
-			wg.Add(1)
-			totalCounter := int64(0)
-			go func() {
-				defer wg.Done()
-				loopLocal(loopCount, &totalCounter)
-			}()
+	totalCounter := int64(0)
+	b.SetParallelism(runtime.GOMAXPROCS(-1))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			loopLocal(loopCount, &totalCounter)
 		}
-		wg.Wait()
-	}
+	})
+}
+
+// BenchmarkLoopSlack runs with 10x the parallelism of GOMAXPROCS, to model
+// an overcommitted scheduler where more goroutines are runnable than there
+// are Ps to run them.
+func BenchmarkLoopSlack(b *testing.B) {
+	totalCounter := int64(0)
+	b.SetParallelism(runtime.GOMAXPROCS(-1) * 10)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			loopLocal(loopCount, &totalCounter)
+		}
+	})
 }
 
 func BenchmarkLoopAtomic(b *testing.B) {
-	for i := 0; i < b.N; i++ {
-		wg := sync.WaitGroup{}
-		for r := 0; r < routineCount; r++ {
-			wg.Add(1)
-			totalCounter := int64(0)
-			go func() {
-				defer wg.Done()
-				loopAtomic(loopCount, &totalCounter)
-			}()
+	totalCounter := int64(0)
+	b.SetParallelism(runtime.GOMAXPROCS(-1))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			loopAtomic(loopCount, &totalCounter)
 		}
-		wg.Wait()
-	}
+	})
+}
+
+// BenchmarkLoopAtomicSlack runs with 10x the parallelism of GOMAXPROCS, to
+// model an overcommitted scheduler where more goroutines are runnable than
+// there are Ps to run them.
+func BenchmarkLoopAtomicSlack(b *testing.B) {
+	totalCounter := int64(0)
+	b.SetParallelism(runtime.GOMAXPROCS(-1) * 10)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			loopAtomic(loopCount, &totalCounter)
+		}
+	})
 }
@@ -16,52 +16,24 @@ It is expected that performance of functions accessing shared pointer will
 degrade with increased number of goroutines due to CPU cache contention and
 invalidation.
 
-Results on my local MBP (8x core i9 CPU, hyper-threaded)
-
-	Philips-MBP:go-bench philip$ go test -cpu="1,2,4,8,16,24" -bench=. -benchtime=10s
-	goos: darwin
-	goarch: amd64
-	pkg: github.com/ppanyukov/go-bench
-	BenchmarkLoopNoPtr        	   25954	    464182 ns/op
-	BenchmarkLoopNoPtr-2      	   23108	    522946 ns/op
-	BenchmarkLoopNoPtr-4      	   18465	    669737 ns/op
-	BenchmarkLoopNoPtr-8      	   13980	    871386 ns/op
-	BenchmarkLoopNoPtr-16     	    8292	   1516591 ns/op
-	BenchmarkLoopNoPtr-24     	    5558	   2237993 ns/op
-
-	BenchmarkLoop             	    7165	   1430208 ns/op
-	BenchmarkLoop-2           	    6310	   1857615 ns/op
-	BenchmarkLoop-4           	    5374	   2331765 ns/op
-	BenchmarkLoop-8           	    3256	   3696851 ns/op
-	BenchmarkLoop-16          	    1819	   6774960 ns/op
-	BenchmarkLoop-24          	    1380	   9080867 ns/op
-
-	BenchmarkLoopAtomic       	    1929	   5865269 ns/op
-	BenchmarkLoopAtomic-2     	     348	  32108845 ns/op
-	BenchmarkLoopAtomic-4     	     190	  63751175 ns/op
-	BenchmarkLoopAtomic-8     	     100	 111437548 ns/op
-	BenchmarkLoopAtomic-16    	      84	 166631953 ns/op
-	BenchmarkLoopAtomic-24    	      55	 209213433 ns/op
-	PASS
-	ok  	github.com/ppanyukov/go-bench	265.088s
-
-These show rapid degradation in performance when shared pointers get modified.
-
+The sample results that used to live in this comment were measured against
+the old sync.WaitGroup-based implementation, where each "op" was an entire
+batch of routineCount() goroutines running the loop to completion. Now that
+these benchmarks run under b.RunParallel, an "op" is one loop run by one of
+b's parallel workers, so the old ns/op numbers are not comparable to what's
+reported today. Run `go test -cpu=1,2,4,8,16,24 -bench=. ./atomics` to get
+current numbers for your machine.
 */
 package atomics
 
 import (
 	"math"
 	"runtime"
-	"sync"
 	"sync/atomic"
 	"testing"
-)
 
-func routineCount() int {
-	res := runtime.GOMAXPROCS(-1)
-	return res
-}
+	"github.com/ppanyukov/go-bench/padded"
+)
 
 var array = func() []int64 {
 	const loopCount = 1000000
@@ -116,49 +88,70 @@ func loopAtomic(array []int64, totalCounter *int64) int64 {
 }
 
 func BenchmarkLoopNoPtr(b *testing.B) {
-	for i := 0; i < b.N; i++ {
-		wg := sync.WaitGroup{}
-		routineCount := routineCount()
-		for r := 0; r < routineCount; r++ {
-			wg.Add(1)
-			totalCounter := int64(0)
-			go func() {
-				defer wg.Done()
-				loopLocalNoPtr(array, &totalCounter)
-			}()
+	b.SetParallelism(runtime.GOMAXPROCS(-1))
+	b.RunParallel(func(pb *testing.PB) {
+		totalCounter := padded.PaddedInt64{}
+		for pb.Next() {
+			loopLocalNoPtr(array, &totalCounter.V)
 		}
-		wg.Wait()
-	}
+	})
+}
+
+// BenchmarkLoopNoPtrSlack runs with 10x the parallelism of GOMAXPROCS, to
+// model an overcommitted scheduler where more goroutines are runnable than
+// there are Ps to run them.
+func BenchmarkLoopNoPtrSlack(b *testing.B) {
+	b.SetParallelism(runtime.GOMAXPROCS(-1) * 10)
+	b.RunParallel(func(pb *testing.PB) {
+		totalCounter := padded.PaddedInt64{}
+		for pb.Next() {
+			loopLocalNoPtr(array, &totalCounter.V)
+		}
+	})
 }
 
 func BenchmarkLoop(b *testing.B) {
-	for i := 0; i < b.N; i++ {
-		wg := sync.WaitGroup{}
-		routineCount := routineCount()
-		totalCounter := int64(0)
-		for r := 0; r < routineCount; r++ {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				loopLocal(array, &totalCounter)
-			}()
+	totalCounter := int64(0)
+	b.SetParallelism(runtime.GOMAXPROCS(-1))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			loopLocal(array, &totalCounter)
 		}
-		wg.Wait()
-	}
+	})
+}
+
+// BenchmarkLoopSlack runs with 10x the parallelism of GOMAXPROCS, to model
+// an overcommitted scheduler where more goroutines are runnable than there
+// are Ps to run them.
+func BenchmarkLoopSlack(b *testing.B) {
+	totalCounter := int64(0)
+	b.SetParallelism(runtime.GOMAXPROCS(-1) * 10)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			loopLocal(array, &totalCounter)
+		}
+	})
 }
 
 func BenchmarkLoopAtomic(b *testing.B) {
-	for i := 0; i < b.N; i++ {
-		wg := sync.WaitGroup{}
-		routineCount := routineCount()
-		totalCounter := int64(0)
-		for r := 0; r < routineCount; r++ {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				loopAtomic(array, &totalCounter)
-			}()
+	totalCounter := int64(0)
+	b.SetParallelism(runtime.GOMAXPROCS(-1))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			loopAtomic(array, &totalCounter)
 		}
-		wg.Wait()
-	}
+	})
+}
+
+// BenchmarkLoopAtomicSlack runs with 10x the parallelism of GOMAXPROCS, to
+// model an overcommitted scheduler where more goroutines are runnable than
+// there are Ps to run them.
+func BenchmarkLoopAtomicSlack(b *testing.B) {
+	totalCounter := int64(0)
+	b.SetParallelism(runtime.GOMAXPROCS(-1) * 10)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			loopAtomic(array, &totalCounter)
+		}
+	})
 }
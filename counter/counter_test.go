@@ -4,11 +4,29 @@ package counter
 
 import (
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	_ "unsafe" // required by the go:linkname directives below
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/ppanyukov/go-bench/padded"
 )
 
+// procPin/procUnpin mirror the unexported runtime functions that sync.Pool
+// uses to pin the calling goroutine to its current P for the duration of a
+// per-P slot access. We link against them directly rather than reimplement
+// the (unsafe) bookkeeping ourselves.
+//
+//go:linkname procPin runtime.procPin
+func procPin() int
+
+//go:linkname procUnpin runtime.procUnpin
+func procUnpin()
+
 // CounterNoLock is a completely no-lock and no-atomic counter. Basically this
 // is the fastest way to increment something within a goroutine. It's here to
 // provide "rock bottom" figures -- you can't go any faster than this.
@@ -24,39 +42,161 @@ func (b *CounterNoLock) Add(val uint64) {
 	b.localCounter += val
 }
 
-
-// CounterBuffer is buffered implementation of counter.
-// It accumulates into local counter an flushes to shared
-// prometheus counter once every flushInterval.
+// CounterBuffer is a buffered prometheus counter. Callers
+// never touch the shared prometheus counter directly: they call Local() to
+// get a per-goroutine LocalCounter, which accumulates into its own local
+// counter and flushes to the shared counter once every flushInterval.
+//
+// Unlike a bare local buffer, a buffered delta is never lost if the caller
+// forgets to Flush: CounterBuffer itself implements prometheus.Collector,
+// and Collect drains every LocalCounter still in its registry before
+// delegating to the inner counter's Collect; a LocalCounter that is
+// garbage collected is drained by its finalizer before it leaves the
+// registry.
 type CounterBuffer struct {
 	inner         prometheus.Counter
 	flushInterval uint64
-	localCounter  uint64
+	locals        sync.Map // *uint64 -> struct{}
 }
 
-func (b *CounterBuffer) Inc() {
-	b.localCounter += 1
-	if b.localCounter > b.flushInterval {
-		b.inner.Add(float64(b.localCounter))
-		b.localCounter = 0
+// NewBufferedCounter creates a CounterBuffer backed by a fresh prometheus
+// counter built from opts. The returned value should be registered once via
+// prometheus.MustRegister; callers then get per-goroutine handles via
+// Local().
+func NewBufferedCounter(opts prometheus.CounterOpts, flushInterval uint64) *CounterBuffer {
+	return &CounterBuffer{
+		inner:         prometheus.NewCounter(opts),
+		flushInterval: flushInterval,
 	}
 }
 
-func (b *CounterBuffer) Add(val uint64) {
-	b.localCounter += val
-	if b.localCounter > b.flushInterval {
-		b.inner.Add(float64(b.localCounter))
-		b.localCounter = 0
+// Local hands out a new per-goroutine LocalCounter. The registry keys on
+// the *uint64 backing the local counter, not on the LocalCounter itself:
+// if it keyed on the LocalCounter, the map entry would hold a permanent
+// reference to it and the finalizer below would never fire. Keying on the
+// backing cell instead lets the LocalCounter become unreachable as soon as
+// the caller drops it, at which point the finalizer drains the cell into
+// the shared counter and removes it from the registry.
+func (b *CounterBuffer) Local() *LocalCounter {
+	counter := new(uint64)
+	b.locals.Store(counter, struct{}{})
+	l := &LocalCounter{parent: b, counter: counter}
+	runtime.SetFinalizer(l, func(l *LocalCounter) {
+		flush(b.inner, l.counter)
+		b.locals.Delete(l.counter)
+	})
+	return l
+}
+
+// Describe implements prometheus.Collector.
+func (b *CounterBuffer) Describe(ch chan<- *prometheus.Desc) {
+	b.inner.Describe(ch)
+}
+
+// Collect implements prometheus.Collector. It drains every counter cell
+// handed out by Local into the shared inner counter, then delegates to the
+// inner counter's Collect, so a scrape always sees up-to-date values even
+// if callers never call Flush themselves.
+func (b *CounterBuffer) Collect(ch chan<- prometheus.Metric) {
+	b.locals.Range(func(key, _ interface{}) bool {
+		flush(b.inner, key.(*uint64))
+		return true
+	})
+	b.inner.Collect(ch)
+}
+
+// LocalCounter is a per-goroutine handle onto a CounterBuffer. It is not
+// safe to share a LocalCounter between goroutines, but it is safe to use
+// concurrently with the CounterBuffer's own Collect, since both update the
+// counter cell with atomic operations.
+type LocalCounter struct {
+	parent  *CounterBuffer
+	counter *uint64
+}
+
+func (l *LocalCounter) Inc() {
+	l.Add(1)
+}
+
+func (l *LocalCounter) Add(val uint64) {
+	if newVal := atomic.AddUint64(l.counter, val); newVal > l.parent.flushInterval {
+		flush(l.parent.inner, l.counter)
+	}
+}
+
+// Flush forces any buffered delta to the shared counter immediately. It is
+// no longer required for correctness (Collect does this automatically),
+// but it is still useful to get a prompt update outside of a scrape.
+func (l *LocalCounter) Flush() {
+	flush(l.parent.inner, l.counter)
+}
+
+// flush drains counter into inner, if there's anything to drain.
+func flush(inner prometheus.Counter, counter *uint64) {
+	if val := atomic.SwapUint64(counter, 0); val > 0 {
+		inner.Add(float64(val))
+	}
+}
+
+// CounterShard is a per-P sharded counter modeled on the internal per-P
+// storage that sync.Pool uses. Instead of a single shared atomic word, it
+// keeps one shard per logical processor (sized by runtime.GOMAXPROCS(0))
+// and, on Inc/Add, pins the calling goroutine to its current P before
+// bumping that shard's counter. Writes still use an atomic add: procPin
+// only guarantees the calling goroutine won't be preempted off its P for
+// the duration of the call, it does not guarantee pid stays within bounds
+// if GOMAXPROCS grows after construction, so two different Ps can end
+// up mapped to the same shard via the modulo below. An atomic add keeps
+// that case race-free; since it's almost always uncontended (at most one
+// goroutine runs per P at a time), it is still far cheaper than a single
+// globally shared atomic counter. Sum/Collect iterate all shards and add
+// them up, so reads stay consistent even while writers are running.
+type CounterShard struct {
+	shards []padded.PaddedUint64
+}
+
+// NewCounterShard returns a CounterShard with one shard per logical CPU.
+func NewCounterShard() *CounterShard {
+	return &CounterShard{
+		shards: make([]padded.PaddedUint64, runtime.GOMAXPROCS(0)),
 	}
 }
 
-func (b *CounterBuffer) Flush() {
-	if b.localCounter > 0 {
-		b.inner.Add(float64(b.localCounter))
-		b.localCounter = 0
+func (c *CounterShard) Inc() {
+	c.Add(1)
+}
+
+func (c *CounterShard) Add(val uint64) {
+	pid := procPin()
+	c.shards[pid%len(c.shards)].Add(val)
+	procUnpin()
+}
+
+// Sum adds up all the shards. It does not pin or lock anything, so it can
+// observe a value that is slightly stale with respect to concurrent
+// writers, but it will never lose an update: every Inc/Add that happened
+// before Sum was called is visible by the time Sum returns, because every
+// shard is written with an atomic add and read with an atomic load.
+func (c *CounterShard) Sum() uint64 {
+	var total uint64
+	for i := range c.shards {
+		total += c.shards[i].Load()
 	}
+	return total
+}
+
+// Describe implements prometheus.Collector.
+func (c *CounterShard) Describe(ch chan<- *prometheus.Desc) {
+	ch <- counterShardDesc
+}
+
+// Collect implements prometheus.Collector by summing all shards into a
+// single counter metric.
+func (c *CounterShard) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(counterShardDesc, prometheus.CounterValue, float64(c.Sum()))
 }
 
+var counterShardDesc = prometheus.NewDesc("counter_shard_total", "Sum of all per-P shards.", nil, nil)
 
 // The fastest kind of counter. Everything is local to goroutine.
 func BenchmarkPromCounterLocalNoLock(b *testing.B) {
@@ -110,11 +250,7 @@ func BenchmarkPromCounterLocalBuf(b *testing.B) {
 			ConstLabels: nil,
 		}
 
-		counter := CounterBuffer{
-			inner:         prometheus.NewCounter(opts),
-			flushInterval: 1000,
-			localCounter:  0,
-		}
+		counter := NewBufferedCounter(opts, 1000).Local()
 
 		for pb.Next() {
 			counter.Add(1)
@@ -157,15 +293,11 @@ func BenchmarkPromCounterSharedBuf(b *testing.B) {
 		ConstLabels: nil,
 	}
 
-	shared := prometheus.NewCounter(opts)
+	shared := NewBufferedCounter(opts, 1000)
 
 	b.SetParallelism(runtime.GOMAXPROCS(-1))
 	b.RunParallel(func(pb *testing.PB) {
-		counter := CounterBuffer{
-			inner:         shared,
-			flushInterval: 1000,
-			localCounter:  0,
-		}
+		counter := shared.Local()
 
 		for pb.Next() {
 			counter.Add(1)
@@ -174,3 +306,124 @@ func BenchmarkPromCounterSharedBuf(b *testing.B) {
 		counter.Flush()
 	})
 }
+
+// Using a sharded counter across several goroutines. Each goroutine only
+// ever touches the shard belonging to its current P, so this is expected
+// to get close to the BenchmarkPromCounterLocalNoLock baseline without
+// needing a buffer/flush dance.
+func BenchmarkPromCounterSharedShard(b *testing.B) {
+	counter := NewCounterShard()
+
+	b.SetParallelism(runtime.GOMAXPROCS(-1))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			counter.Add(1)
+			counter.Inc()
+		}
+	})
+}
+
+// TestCounterShardSum spawns N goroutines, each doing M Inc calls, and
+// checks that Sum() reports the total across all shards.
+func TestCounterShardSum(t *testing.T) {
+	const goroutines = 64
+	const incsPerGoroutine = 10000
+
+	counter := NewCounterShard()
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < incsPerGoroutine; j++ {
+				counter.Inc()
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := uint64(goroutines * incsPerGoroutine)
+	if got := counter.Sum(); got != want {
+		t.Fatalf("Sum() = %d, want %d", got, want)
+	}
+}
+
+// TestCounterBufferCollectWithoutFlush spawns N goroutines, each doing M
+// increments without ever calling Flush, then triggers a scrape via
+// Collect and checks that the exposed counter equals N*M: a scrape must
+// never lose a buffered delta just because the caller forgot to flush it.
+func TestCounterBufferCollectWithoutFlush(t *testing.T) {
+	const goroutines = 32
+	const incsPerGoroutine = 5000
+
+	opts := prometheus.CounterOpts{
+		Name: "test_counter_buffer_total",
+		Help: "test counter",
+	}
+	buffered := NewBufferedCounter(opts, 1000)
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			local := buffered.Local()
+			for j := 0; j < incsPerGoroutine; j++ {
+				local.Inc()
+			}
+		}()
+	}
+	wg.Wait()
+
+	ch := make(chan prometheus.Metric, 1)
+	buffered.Collect(ch)
+	close(ch)
+
+	var m dto.Metric
+	if err := (<-ch).Write(&m); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+
+	want := float64(goroutines * incsPerGoroutine)
+	if got := m.GetCounter().GetValue(); got != want {
+		t.Fatalf("Collect() reported %v, want %v", got, want)
+	}
+}
+
+// registrySize returns the number of entries currently in the registry.
+func registrySize(b *CounterBuffer) int {
+	n := 0
+	b.locals.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// TestCounterBufferLocalIsCollectedWhenUnreachable checks that dropping a
+// LocalCounter and forcing a GC removes its entry from the registry, i.e.
+// that CounterBuffer.locals does not grow without bound for the lifetime
+// of the process.
+func TestCounterBufferLocalIsCollectedWhenUnreachable(t *testing.T) {
+	opts := prometheus.CounterOpts{
+		Name: "test_counter_buffer_gc_total",
+		Help: "test counter",
+	}
+	buffered := NewBufferedCounter(opts, 1000)
+
+	func() {
+		local := buffered.Local()
+		local.Inc()
+	}()
+
+	for i := 0; i < 10; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+		if registrySize(buffered) == 0 {
+			return
+		}
+	}
+
+	t.Fatalf("registry still has %d entries after GC, want 0", registrySize(buffered))
+}
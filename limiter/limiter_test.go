@@ -1,23 +1,34 @@
 package limiter
 
 import (
+	"context"
 	"errors"
 	"math"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/ppanyukov/go-bench/padded"
 )
 
 var limitReached error = errors.New("limit reached")
 
+// current is padded.PaddedInt64 rather than a plain int64 so that the
+// padding after it keeps whatever follows this struct in memory (e.g.
+// another goroutine's limiterNoLock) off its cache line. limit, which sits
+// directly before current, still shares that cache line.
 type limiterNoLock struct {
 	limit   int64
-	current int64
+	current padded.PaddedInt64
 }
 
 func (l *limiterNoLock) Add(val int64) error {
-	l.current += val
-	if l.current > l.limit {
+	l.current.V += val
+	if l.current.V > l.limit {
 		return limitReached
 	}
 
@@ -26,11 +37,11 @@ func (l *limiterNoLock) Add(val int64) error {
 
 type limiterAtomic struct {
 	limit   int64
-	current int64
+	current padded.PaddedInt64
 }
 
 func (l *limiterAtomic) Add(val int64) error {
-	current := atomic.AddInt64(&l.current, val)
+	current := l.current.Add(val)
 	if current > l.limit {
 		return limitReached
 	}
@@ -38,20 +49,25 @@ func (l *limiterAtomic) Add(val int64) error {
 	return nil
 }
 
+// currentLocal and currentShared are padded.PaddedInt64 rather than plain
+// int64/*int64: currentShared is hammered with atomic.AddInt64 by every
+// goroutine sharing the limiter, and currentLocal is a per-goroutine
+// instance of this struct that can land next to another goroutine's on
+// the heap, so both are false-sharing hazards.
 type limiterAtomicBuffered struct {
 	limit         int64
 	flushInterval int64
-	currentLocal  int64
-	currentShared *int64
+	currentLocal  padded.PaddedInt64
+	currentShared *padded.PaddedInt64
 }
 
 func (l *limiterAtomicBuffered) Add(val int64) error {
 	// buffer into local counter until we buffered enough,
 	// then flush to shared counter using atomic increment
-	l.currentLocal += val
-	if l.currentLocal > l.flushInterval {
-		newCurrentShared := atomic.AddInt64(l.currentShared, l.currentLocal)
-		l.currentLocal = 0
+	l.currentLocal.V += val
+	if l.currentLocal.V > l.flushInterval {
+		newCurrentShared := l.currentShared.Add(l.currentLocal.V)
+		l.currentLocal.V = 0
 		if newCurrentShared > l.limit {
 			return limitReached
 		}
@@ -60,12 +76,220 @@ func (l *limiterAtomicBuffered) Add(val int64) error {
 	return nil
 }
 
+// Limiter is the common interface implemented by the rate-limiting
+// experiments below. Its method names follow golang.org/x/time/rate.Limiter,
+// but AllowN takes only a token count (no time argument), so these types
+// are not drop-in replacements for *rate.Limiter.
+type Limiter interface {
+	Allow() bool
+	AllowN(n int64) bool
+	Wait(ctx context.Context) error
+}
+
+// AtomicTokenBucket is a single-word token bucket: its tokens live in one
+// int64, refilled lazily from time.Now() deltas on every Allow/AllowN, and
+// claimed with a compare-and-swap retry loop. There is no sharding and no
+// buffering, so every call contends on the same cache line -- this is the
+// baseline the other two implementations are measured against.
+type AtomicTokenBucket struct {
+	rate  rate.Limit // tokens granted per second
+	burst int64      // bucket capacity
+
+	tokens    int64 // current token count
+	lastNanos int64 // unix nanos of the last refill
+}
+
+func NewAtomicTokenBucket(r rate.Limit, burst int64) *AtomicTokenBucket {
+	return &AtomicTokenBucket{
+		rate:      r,
+		burst:     burst,
+		tokens:    burst,
+		lastNanos: time.Now().UnixNano(),
+	}
+}
+
+func (l *AtomicTokenBucket) Allow() bool {
+	return l.AllowN(1)
+}
+
+func (l *AtomicTokenBucket) AllowN(n int64) bool {
+	for {
+		now := time.Now().UnixNano()
+		last := atomic.LoadInt64(&l.lastNanos)
+
+		if elapsed := now - last; elapsed > 0 {
+			if refill := int64(float64(elapsed) / float64(time.Second) * float64(l.rate)); refill > 0 {
+				if !atomic.CompareAndSwapInt64(&l.lastNanos, last, now) {
+					continue
+				}
+				// Add the refill with a CAS-retry loop rather than a
+				// plain Store: a concurrent AllowN may have decremented
+				// l.tokens between our load above and here, and a Store
+				// of a value computed from our stale snapshot would
+				// silently clobber that decrement.
+				for {
+					old := atomic.LoadInt64(&l.tokens)
+					updated := old + refill
+					if updated > l.burst {
+						updated = l.burst
+					}
+					if atomic.CompareAndSwapInt64(&l.tokens, old, updated) {
+						break
+					}
+				}
+			}
+		}
+
+		tokens := atomic.LoadInt64(&l.tokens)
+		if tokens < n {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&l.tokens, tokens, tokens-n) {
+			return true
+		}
+	}
+}
+
+func (l *AtomicTokenBucket) Wait(ctx context.Context) error {
+	for {
+		if l.Allow() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// BufferedTokenBucket draws tokens from a shared AtomicTokenBucket in bulk
+// reservations of reserveSize, amortizing the CAS cost of AtomicTokenBucket
+// over reserveSize calls -- the same pattern limiterAtomicBuffered uses for
+// plain limits. It is meant to be used as a per-goroutine local handle onto
+// one shared bucket, not shared between goroutines itself.
+type BufferedTokenBucket struct {
+	shared      *AtomicTokenBucket
+	reserveSize int64
+	reserved    int64
+}
+
+func NewBufferedTokenBucket(shared *AtomicTokenBucket, reserveSize int64) *BufferedTokenBucket {
+	return &BufferedTokenBucket{shared: shared, reserveSize: reserveSize}
+}
+
+func (l *BufferedTokenBucket) Allow() bool {
+	return l.AllowN(1)
+}
+
+func (l *BufferedTokenBucket) AllowN(n int64) bool {
+	if l.reserved >= n {
+		l.reserved -= n
+		return true
+	}
+
+	need := l.reserveSize
+	if need < n {
+		need = n
+	}
+	if !l.shared.AllowN(need) {
+		return false
+	}
+	l.reserved += need - n
+	return true
+}
+
+func (l *BufferedTokenBucket) Wait(ctx context.Context) error {
+	for {
+		if l.Allow() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// ShardedTokenBucket keeps one AtomicTokenBucket per P (sized by
+// runtime.GOMAXPROCS(0)), each refilling at rate/numShards. Allow picks a
+// shard via an atomic round-robin cursor; if that shard is dry it steals
+// from the following shards in turn, and rejects only once every shard has
+// been tried, trading a little
+// precision for much lower contention under heavy parallelism.
+type ShardedTokenBucket struct {
+	shards []AtomicTokenBucket
+	cursor uint64
+}
+
+func NewShardedTokenBucket(r rate.Limit, burst int64) *ShardedTokenBucket {
+	numShards := runtime.GOMAXPROCS(0)
+	shards := make([]AtomicTokenBucket, numShards)
+	now := time.Now().UnixNano()
+
+	// burst/numShards truncates to 0 whenever burst < numShards, which
+	// would leave every shard permanently empty. Give each shard at
+	// least 1 token of burst. When burst >= numShards, the remainder
+	// tops up that many shards by 1 so the shards sum to burst overall;
+	// when burst < numShards, every shard gets exactly 1 and the shards
+	// sum to numShards.
+	perShard := burst / int64(numShards)
+	remainder := burst % int64(numShards)
+	if perShard < 1 {
+		perShard = 1
+		remainder = 0
+	}
+
+	for i := range shards {
+		shardBurst := perShard
+		if int64(i) < remainder {
+			shardBurst++
+		}
+		shards[i] = AtomicTokenBucket{
+			rate:      r / rate.Limit(numShards),
+			burst:     shardBurst,
+			tokens:    shardBurst,
+			lastNanos: now,
+		}
+	}
+	return &ShardedTokenBucket{shards: shards}
+}
+
+func (l *ShardedTokenBucket) Allow() bool {
+	return l.AllowN(1)
+}
+
+func (l *ShardedTokenBucket) AllowN(n int64) bool {
+	numShards := uint64(len(l.shards))
+	start := atomic.AddUint64(&l.cursor, 1)
+	for i := uint64(0); i < numShards; i++ {
+		shard := &l.shards[(start+i)%numShards]
+		if shard.AllowN(n) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *ShardedTokenBucket) Wait(ctx context.Context) error {
+	for {
+		if l.Allow() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
 func BenchmarkLimiterLocalNoLock(b *testing.B) {
 	b.SetParallelism(runtime.GOMAXPROCS(-1))
 	b.RunParallel(func(pb *testing.PB) {
 		limiter := &limiterNoLock{
-			limit:   math.MaxInt64,
-			current: 0,
+			limit: math.MaxInt64,
 		}
 
 		for pb.Next() {
@@ -78,8 +302,7 @@ func BenchmarkLimiterLocalNoLock(b *testing.B) {
 
 func BenchmarkLimiterSharedNoLockRace(b *testing.B) {
 	limiter := &limiterNoLock{
-		limit:   math.MaxInt64,
-		current: 0,
+		limit: math.MaxInt64,
 	}
 
 	b.SetParallelism(runtime.GOMAXPROCS(-1))
@@ -92,8 +315,7 @@ func BenchmarkLimiterSharedNoLockRace(b *testing.B) {
 
 func BenchmarkLimiterSharedAtomic(b *testing.B) {
 	limiter := &limiterAtomic{
-		limit:   math.MaxInt64,
-		current: 0,
+		limit: math.MaxInt64,
 	}
 
 	b.SetParallelism(runtime.GOMAXPROCS(-1))
@@ -107,14 +329,13 @@ func BenchmarkLimiterSharedAtomic(b *testing.B) {
 }
 
 func BenchmarkLimiterSharedAtomicBuf(b *testing.B) {
-	var shared = int64(0)
+	var shared padded.PaddedInt64
 
 	b.SetParallelism(runtime.GOMAXPROCS(-1))
 	b.RunParallel(func(pb *testing.PB) {
 		limiter := &limiterAtomicBuffered{
 			limit:         math.MaxInt64,
 			flushInterval: 1000,
-			currentLocal:  0,
 			currentShared: &shared,
 		}
 
@@ -126,4 +347,169 @@ func BenchmarkLimiterSharedAtomicBuf(b *testing.B) {
 	})
 }
 
+// go test -cpu="1,2,4,8,16,24" -bench=BenchmarkTokenBucket ./limiter
+
+func BenchmarkTokenBucketAtomicShared(b *testing.B) {
+	limiter := NewAtomicTokenBucket(rate.Limit(math.MaxInt64), math.MaxInt64)
+
+	b.SetParallelism(runtime.GOMAXPROCS(-1))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			limiter.Allow()
+		}
+	})
+}
+
+func BenchmarkTokenBucketBufferedShared(b *testing.B) {
+	shared := NewAtomicTokenBucket(rate.Limit(math.MaxInt64), math.MaxInt64)
+
+	b.SetParallelism(runtime.GOMAXPROCS(-1))
+	b.RunParallel(func(pb *testing.PB) {
+		limiter := NewBufferedTokenBucket(shared, 1000)
+
+		for pb.Next() {
+			limiter.Allow()
+		}
+	})
+}
+
+func BenchmarkTokenBucketSharded(b *testing.B) {
+	limiter := NewShardedTokenBucket(rate.Limit(math.MaxInt64), math.MaxInt64)
+
+	b.SetParallelism(runtime.GOMAXPROCS(-1))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			limiter.Allow()
+		}
+	})
+}
+
+// testObservedRate hammers limiter from concurrency goroutines for
+// duration and returns the observed rate of allowed calls per second.
+func testObservedRate(limiter Limiter, concurrency int, duration time.Duration) float64 {
+	var allowed int64
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(duration)
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				if limiter.Allow() {
+					atomic.AddInt64(&allowed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
 
+	return float64(allowed) / duration.Seconds()
+}
+
+// assertWithinTolerance fails the test if got is not within frac of want.
+func assertWithinTolerance(t *testing.T, got, want, frac float64) {
+	t.Helper()
+	if diff := math.Abs(got - want); diff > want*frac {
+		t.Fatalf("observed rate %.1f, want within %.0f%% of %.1f", got, frac*100, want)
+	}
+}
+
+func TestAtomicTokenBucketRate(t *testing.T) {
+	const want = 2000.0
+	limiter := NewAtomicTokenBucket(rate.Limit(want), 50)
+
+	got := testObservedRate(limiter, runtime.GOMAXPROCS(-1), 200*time.Millisecond)
+	assertWithinTolerance(t, got, want, 0.3)
+}
+
+func TestBufferedTokenBucketRate(t *testing.T) {
+	const want = 2000.0
+	shared := NewAtomicTokenBucket(rate.Limit(want), 50)
+
+	var wg sync.WaitGroup
+	var allowed int64
+	duration := 200 * time.Millisecond
+	deadline := time.Now().Add(duration)
+
+	for i := 0; i < runtime.GOMAXPROCS(-1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limiter := NewBufferedTokenBucket(shared, 10)
+			for time.Now().Before(deadline) {
+				if limiter.Allow() {
+					atomic.AddInt64(&allowed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	got := float64(allowed) / duration.Seconds()
+	assertWithinTolerance(t, got, want, 0.3)
+}
+
+func TestShardedTokenBucketRate(t *testing.T) {
+	const want = 2000.0
+	limiter := NewShardedTokenBucket(rate.Limit(want), 50)
+
+	got := testObservedRate(limiter, runtime.GOMAXPROCS(-1), 200*time.Millisecond)
+	assertWithinTolerance(t, got, want, 0.3)
+}
+
+// TestShardedTokenBucketSmallBurst guards against burst/numShards truncating
+// to 0 and leaving every shard permanently empty when burst < GOMAXPROCS: if
+// that regresses, the observed rate here collapses to 0 and the tolerance
+// check below fails.
+func TestShardedTokenBucketSmallBurst(t *testing.T) {
+	numShards := runtime.GOMAXPROCS(-1)
+	if numShards < 2 {
+		t.Skip("needs GOMAXPROCS > 1 to exercise burst < numShards")
+	}
+
+	const want = 500.0
+	burst := int64(numShards - 1)
+	limiter := NewShardedTokenBucket(rate.Limit(want), burst)
+
+	got := testObservedRate(limiter, numShards, 200*time.Millisecond)
+	assertWithinTolerance(t, got, want, 0.4)
+}
+
+// TestAtomicTokenBucketNeverOverGrants hammers a single AtomicTokenBucket
+// from many goroutines and checks that it never grants more tokens than its
+// burst plus whatever the rate could have refilled over the run -- i.e. that
+// the CAS-retry refill in AllowN can't be clobbered into handing out tokens
+// it never actually had.
+func TestAtomicTokenBucketNeverOverGrants(t *testing.T) {
+	const (
+		r     = rate.Limit(1000)
+		burst = int64(50)
+	)
+	limiter := NewAtomicTokenBucket(r, burst)
+
+	var granted int64
+	var wg sync.WaitGroup
+	duration := 200 * time.Millisecond
+	deadline := time.Now().Add(duration)
+
+	for i := 0; i < runtime.GOMAXPROCS(-1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				if limiter.Allow() {
+					atomic.AddInt64(&granted, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	remaining := atomic.LoadInt64(&limiter.tokens)
+	maxPossible := burst + int64(float64(duration)/float64(time.Second)*float64(r)) + 1
+	if granted+remaining > maxPossible {
+		t.Fatalf("granted(%d) + remaining(%d) = %d, want <= burst + elapsed*rate (%d)",
+			granted, remaining, granted+remaining, maxPossible)
+	}
+}
@@ -0,0 +1,74 @@
+// go test -cpu="1,2,4,8,16,24" -bench=BenchmarkFalseSharing ./padded
+package padded
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+)
+
+func TestSizes(t *testing.T) {
+	if got := unsafe.Sizeof(PaddedInt64{}); got != cacheLineSize {
+		t.Fatalf("unsafe.Sizeof(PaddedInt64{}) = %d, want %d", got, cacheLineSize)
+	}
+	if got := unsafe.Sizeof(PaddedUint64{}); got != cacheLineSize {
+		t.Fatalf("unsafe.Sizeof(PaddedUint64{}) = %d, want %d", got, cacheLineSize)
+	}
+	if got := unsafe.Sizeof(PaddedPointer{}); got != cacheLineSize {
+		t.Fatalf("unsafe.Sizeof(PaddedPointer{}) = %d, want %d", got, cacheLineSize)
+	}
+}
+
+func TestPaddedInt64(t *testing.T) {
+	var v PaddedInt64
+	v.Store(1)
+	if got := v.Add(2); got != 3 {
+		t.Fatalf("Add(2) = %d, want 3", got)
+	}
+	if got := v.Load(); got != 3 {
+		t.Fatalf("Load() = %d, want 3", got)
+	}
+	if !v.CompareAndSwap(3, 4) {
+		t.Fatalf("CompareAndSwap(3, 4) = false, want true")
+	}
+	if got := v.Load(); got != 4 {
+		t.Fatalf("Load() = %d, want 4", got)
+	}
+}
+
+// BenchmarkFalseSharingUnpadded has each parallel worker hammer its own
+// slot in a plain []int64 slice. Neighbouring slots share cache lines, so
+// cores repeatedly invalidate each other's caches even though no two
+// workers ever touch the same slot. Parallelism is 1, so RunParallel starts
+// exactly GOMAXPROCS workers, one for each slot.
+func BenchmarkFalseSharingUnpadded(b *testing.B) {
+	n := runtime.GOMAXPROCS(-1)
+	counters := make([]int64, n)
+	var next int64
+
+	b.SetParallelism(1)
+	b.RunParallel(func(pb *testing.PB) {
+		slot := int(atomic.AddInt64(&next, 1)-1) % n
+		for pb.Next() {
+			atomic.AddInt64(&counters[slot], 1)
+		}
+	})
+}
+
+// BenchmarkFalseSharingPadded is the same workload as
+// BenchmarkFalseSharingUnpadded, but each worker's slot is a PaddedInt64,
+// so neighbours never share a cache line.
+func BenchmarkFalseSharingPadded(b *testing.B) {
+	n := runtime.GOMAXPROCS(-1)
+	counters := make([]PaddedInt64, n)
+	var next int64
+
+	b.SetParallelism(1)
+	b.RunParallel(func(pb *testing.PB) {
+		slot := int(atomic.AddInt64(&next, 1)-1) % n
+		for pb.Next() {
+			counters[slot].Add(1)
+		}
+	})
+}